@@ -7,6 +7,7 @@ import (
 	"os"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/hexdecteam/easegateway/pkg/common"
 	"github.com/hexdecteam/easegateway/pkg/logger"
@@ -18,8 +19,26 @@ type OperationAppended func(seq uint64, newOperation *Operation) (error, Operati
 
 const (
 	maxSeqKey = "maxSeqKey"
+	minSeqKey = "minSeqKey"
+
+	// snapKeyPrefix namespaces snapshot payloads into their own badger
+	// key family, separate from raw per-sequence operations.
+	snapKeyPrefix = "snap/"
+
+	defaultCleanupInterval = 10 * time.Minute
+
+	cleanupBatchSize = 100
+
+	appendCASMaxRetries = 5
+	appendCASBackoff    = 20 * time.Millisecond
 )
 
+// ErrCompacted is returned by Retrieve when startSeq falls below the
+// watermark that the snapshot subsystem has already compacted away.
+// Callers should fetch LatestSnapshot and resume from there instead of
+// retrying the same startSeq.
+var ErrCompacted = fmt.Errorf("oplog: requested sequence has been compacted")
+
 // TODO: Replace badger with readable text (self-implement maybe).
 
 // opLog's methods prefixed by underscore(_) can't be invoked by other functions
@@ -28,6 +47,7 @@ type opLog struct {
 	db                         *badger.DB
 	operationAppendedCallbacks *common.NamedCallbackSet
 	path                       string
+	cleanupInterval            time.Duration
 }
 
 func NewOPLog(path string) (*opLog, error) {
@@ -69,6 +89,7 @@ func NewOPLog(path string) (*opLog, error) {
 		db:                         db,
 		operationAppendedCallbacks: common.NewNamedCallbackSet(),
 		path:                       path,
+		cleanupInterval:            defaultCleanupInterval,
 	}
 
 	if new { // init max sequence to prevent fake read error
@@ -83,11 +104,25 @@ func NewOPLog(path string) (*opLog, error) {
 		}
 	}
 
+	if err := op._recoverWatermark(); err != nil {
+		logger.Errorf("[BUG: recover oplog watermark failed: %v]", err)
+	}
+
 	go op._cleanup()
 
 	return op, nil
 }
 
+// SetCleanupInterval overrides how often the background compaction
+// loop runs; it takes effect on the loop's next tick.
+func (op *opLog) SetCleanupInterval(d time.Duration) {
+	op.Lock()
+	defer op.Unlock()
+	if d > 0 {
+		op.cleanupInterval = d
+	}
+}
+
 func (op *opLog) Path() string {
 	return op.path
 }
@@ -114,10 +149,75 @@ func (op *opLog) MinSeq() uint64 {
 	return op._locklessReadMinSeq(txn)
 }
 
+// Append appends operations starting at startSeq, failing the whole
+// batch on any sequence conflict. It's implemented on top of
+// AppendCAS with a no-op updater that always declines to rebase, so
+// behavior is unchanged from before AppendCAS existed.
 func (op *opLog) Append(startSeq uint64, operations []*Operation) (error, ClusterErrorType) {
 	if len(operations) == 0 {
 		return nil, NoneClusterError
 	}
+	if startSeq == 0 {
+		return fmt.Errorf("invalid sequential operation"), InternalServerError
+	}
+
+	noopUpdate := func(current uint64) ([]*Operation, error) {
+		return nil, fmt.Errorf("operation conflict")
+	}
+
+	return op.AppendCAS(startSeq-1, operations, noopUpdate)
+}
+
+// AppendCAS appends ops only if the oplog's max sequence still equals
+// expectedMaxSeq, borrowing etcd3's optimistic-concurrency pattern. On
+// conflict — another writer already advanced maxSeq — tryUpdate is
+// invoked with the freshly observed max sequence so the caller can
+// rebase/merge its proposed operations (e.g. rewrite pipeline
+// references) instead of failing outright; a nil tryUpdate, or one
+// that itself errors, fails the attempt with its original conflict
+// error. Each attempt runs in its own badger transaction and retries
+// with a bounded, exponential backoff.
+func (op *opLog) AppendCAS(expectedMaxSeq uint64, ops []*Operation, tryUpdate func(current uint64) ([]*Operation, error)) (error, ClusterErrorType) {
+	backoff := appendCASBackoff
+
+	for attempt := 0; attempt < appendCASMaxRetries; attempt++ {
+		// origStateIsCurrent fast path: the first attempt trusts the
+		// caller's expectedMaxSeq and goes straight to the CAS'd write;
+		// only a detected conflict pays for an extra round-trip.
+		err, clusterErrType, conflict, observedMaxSeq := op._tryAppend(expectedMaxSeq, ops)
+		if !conflict {
+			return err, clusterErrType
+		}
+
+		if tryUpdate == nil {
+			return err, clusterErrType
+		}
+
+		newOps, updateErr := tryUpdate(observedMaxSeq)
+		if updateErr != nil {
+			return err, clusterErrType
+		}
+
+		ops = newOps
+		expectedMaxSeq = observedMaxSeq
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	return fmt.Errorf("operation conflict after %d attempts", appendCASMaxRetries), OperationSeqConflictError
+}
+
+// _tryAppend performs a single CAS attempt: it opens a fresh badger
+// transaction, re-reads maxSeqKey inside it and compares against
+// expectedMaxSeq before writing anything. The returned conflict flag
+// is true only when another writer has already advanced past
+// expectedMaxSeq (worth retrying); a malformed request reports
+// conflict=false since retrying it would never succeed.
+func (op *opLog) _tryAppend(expectedMaxSeq uint64, operations []*Operation) (error, ClusterErrorType, bool, uint64) {
+	if len(operations) == 0 {
+		return nil, NoneClusterError, false, expectedMaxSeq
+	}
 
 	op.Lock()
 	defer op.Unlock()
@@ -126,13 +226,14 @@ func (op *opLog) Append(startSeq uint64, operations []*Operation) (error, Cluste
 	defer txn.Discard()
 
 	ms := op._locklessReadMaxSeq(txn)
+	startSeq := expectedMaxSeq + 1
 
 	if startSeq == 0 {
-		return fmt.Errorf("invalid sequential operation"), InternalServerError
+		return fmt.Errorf("invalid sequential operation"), InternalServerError, false, ms
 	} else if startSeq > ms+1 {
-		return fmt.Errorf("invalid sequential operation"), OperationInvalidSeqError
+		return fmt.Errorf("invalid sequential operation"), OperationInvalidSeqError, false, ms
 	} else if startSeq < ms+1 {
-		return fmt.Errorf("operation conflict"), OperationSeqConflictError
+		return fmt.Errorf("operation conflict"), OperationSeqConflictError, true, ms
 	}
 
 	for idx, operation := range operations {
@@ -144,7 +245,7 @@ func (op *opLog) Append(startSeq uint64, operations []*Operation) (error, Cluste
 		case operation.ContentUpdatePipeline != nil:
 		case operation.ContentDeletePipeline != nil:
 		default:
-			return fmt.Errorf("operation content is empty"), OperationInvalidContentError
+			return fmt.Errorf("operation content is empty"), OperationInvalidContentError, false, ms
 		}
 
 		opBuff, err := json.Marshal(operation)
@@ -152,20 +253,20 @@ func (op *opLog) Append(startSeq uint64, operations []*Operation) (error, Cluste
 			logger.Errorf("[BUG: marshal operation (sequence=%d) %#v failed: %v]",
 				startSeq+uint64(idx), operation, err)
 			return fmt.Errorf("marshal operation (sequence=%d) %#v failed: %v",
-				startSeq+uint64(idx), operation, err), OperationInvalidContentError
+				startSeq+uint64(idx), operation, err), OperationInvalidContentError, false, ms
 		}
 
 		err = txn.Set([]byte(fmt.Sprintf("%d", startSeq+uint64(idx))), opBuff)
 		if err != nil {
 			logger.Errorf("[set operation (sequence=%d) to badger failed: %v]", startSeq+uint64(idx), err)
 			return fmt.Errorf("set operation (sequence=%d) to badger failed: %v",
-				startSeq+uint64(idx), err), InternalServerError
+				startSeq+uint64(idx), err), InternalServerError, false, ms
 		}
 
 		_, err = op._locklessIncreaseMaxSeq(txn)
 		if err != nil {
 			logger.Errorf("[update max operation sequence failed: %v]", err)
-			return fmt.Errorf("update max operation sequence failed: %v", err), InternalServerError
+			return fmt.Errorf("update max operation sequence failed: %v", err), InternalServerError, false, ms
 		}
 
 		for _, cb := range op.operationAppendedCallbacks.GetCallbacks() {
@@ -193,7 +294,7 @@ func (op *opLog) Append(startSeq uint64, operations []*Operation) (error, Cluste
 					clusterErrType = OperationUnknownFailureError
 				}
 
-				return fmt.Errorf("operation (sequence=%d) failed: %v", startSeq+uint64(idx), err), clusterErrType
+				return fmt.Errorf("operation (sequence=%d) failed: %v", startSeq+uint64(idx), err), clusterErrType, false, ms
 			}
 		}
 	}
@@ -201,10 +302,10 @@ func (op *opLog) Append(startSeq uint64, operations []*Operation) (error, Cluste
 	err := txn.Commit(nil)
 	if err != nil {
 		logger.Errorf("[BUG: commit transaction failed: %v]", err)
-		return fmt.Errorf("commit transaction failed: %v", err), NoneClusterError
+		return fmt.Errorf("commit transaction failed: %v", err), NoneClusterError, false, ms
 	}
 
-	return nil, NoneClusterError
+	return nil, NoneClusterError, false, startSeq + uint64(len(operations)) - 1
 }
 
 // retrieve logs whose sequence are [startSeq, MIN(max-sequence, startSeq + countLimit - 1)]
@@ -214,11 +315,14 @@ func (op *opLog) Retrieve(startSeq, countLimit uint64) ([]*Operation, error, Clu
 	defer txn.Discard()
 
 	ms := op._locklessReadMaxSeq(txn)
+	minSeq := op._locklessReadMinSeq(txn)
 
 	var ret []*Operation
 
 	if startSeq == 0 {
 		return nil, fmt.Errorf("invalid begin sequential operation"), InternalServerError
+	} else if startSeq < minSeq {
+		return nil, ErrCompacted, OperationInvalidSeqError
 	} else if startSeq > ms {
 		return ret, nil, NoneClusterError
 	}
@@ -256,6 +360,112 @@ func (op *opLog) Retrieve(startSeq, countLimit uint64) ([]*Operation, error, Clu
 	return ret, nil, NoneClusterError
 }
 
+// Snapshot records payload as the applied state through seq and moves
+// the min-sequence watermark to seq+1: operations [1, seq] are now
+// redundant (their effect is captured by payload) and become eligible
+// for compaction by _cleanup, while operations after seq are untouched.
+// The snap/* key superseded by this one is deleted in the same
+// transaction, so snapshot blobs don't accumulate unbounded across
+// repeated calls.
+func (op *opLog) Snapshot(seq uint64, payload []byte) error {
+	op.Lock()
+	defer op.Unlock()
+
+	txn := op.db.NewTransaction(true)
+	defer txn.Discard()
+
+	ms := op._locklessReadMaxSeq(txn)
+	if seq > ms {
+		return fmt.Errorf("snapshot sequence %d is beyond max sequence %d", seq, ms)
+	}
+
+	// A snapshot whose new watermark (seq+1) isn't past the current one
+	// would re-take the latest snapshot or move minSeqKey backward over
+	// operations _cleanup has already deleted: in the latter case Retrieve
+	// would then let startSeq pass the ErrCompacted guard and fail on a
+	// missing badger key instead. Reject it instead of rewriting history.
+	if minSeq := op._locklessReadMinSeq(txn); seq+1 <= minSeq {
+		return fmt.Errorf("snapshot sequence %d is behind current min sequence %d", seq, minSeq)
+	}
+
+	hadPrev, prevSeq := op._locklessReadSnapshotSeq(txn)
+
+	err := txn.Set([]byte(fmt.Sprintf("%s%d", snapKeyPrefix, seq)), payload)
+	if err != nil {
+		return fmt.Errorf("set snapshot (sequence=%d) to badger failed: %v", seq, err)
+	}
+
+	_, err = op._locklessWriteMinSeq(txn, seq+1)
+	if err != nil {
+		return fmt.Errorf("update min sequence failed: %v", err)
+	}
+
+	if hadPrev && prevSeq != seq {
+		if err := txn.Delete([]byte(fmt.Sprintf("%s%d", snapKeyPrefix, prevSeq))); err != nil {
+			logger.Errorf("[delete superseded snapshot (sequence=%d) from badger failed: %v]", prevSeq, err)
+		}
+	}
+
+	err = txn.Commit(nil)
+	if err != nil {
+		return fmt.Errorf("commit snapshot (sequence=%d) transaction failed: %v", seq, err)
+	}
+
+	return nil
+}
+
+// LatestSnapshot returns the most recently stored snapshot, identified
+// by the sequence it was taken at. It returns seq == 0 and a nil
+// payload when no snapshot has ever been taken.
+func (op *opLog) LatestSnapshot() (uint64, []byte, error) {
+	op.RLock()
+	defer op.RUnlock()
+
+	txn := op.db.NewTransaction(false)
+	defer txn.Discard()
+
+	hasSnapshot, snapSeq := op._locklessReadSnapshotSeq(txn)
+	if !hasSnapshot {
+		return 0, nil, nil
+	}
+
+	snapItem, err := txn.Get([]byte(fmt.Sprintf("%s%d", snapKeyPrefix, snapSeq)))
+	if err != nil {
+		return 0, nil, fmt.Errorf("get snapshot (sequence=%d) from badger failed: %v", snapSeq, err)
+	}
+
+	payload, err := snapItem.Value()
+	if err != nil {
+		return 0, nil, fmt.Errorf("get snapshot (sequence=%d) value failed: %v", snapSeq, err)
+	}
+
+	return snapSeq, payload, nil
+}
+
+// _locklessReadSnapshotSeq reports whether a prior Snapshot call has
+// ever committed and, if so, the sequence it was taken at.
+func (op *opLog) _locklessReadSnapshotSeq(txn *badger.Txn) (bool, uint64) {
+	item, err := txn.Get([]byte(minSeqKey))
+	if err == badger.ErrKeyNotFound {
+		return false, 0
+	} else if err != nil {
+		logger.Errorf("[get min sequence from badger failed: %v]", err)
+		return false, 0
+	}
+
+	v, err := item.Value()
+	if err != nil || v == nil || len(v) == 0 {
+		return false, 0
+	}
+
+	minSeq, err := strconv.ParseUint(string(v), 0, 64)
+	if err != nil || minSeq == 0 {
+		return false, 0
+	}
+
+	return true, minSeq - 1
+}
+
 func (op *opLog) Close() error {
 	return op.db.Close()
 }
@@ -274,13 +484,34 @@ func (op *opLog) DeleteOPLogAppendedCallback(name string) {
 
 ////
 
-// _locklessReadMinSeq is designed to be invoked by locked methods of opLog
+// _locklessReadMinSeq is designed to be invoked by locked methods of opLog.
+// It returns the true minimum sequence still retrievable: before any
+// Snapshot has been taken that's 1 (or 0 on an empty log), and after a
+// Snapshot it's the watermark left by the most recent one.
 func (op *opLog) _locklessReadMinSeq(txn *badger.Txn) uint64 {
-	// FIXME(shengdong) implement this when we need oplog shrank
-	if op._locklessReadMaxSeq(txn) > 0 {
-		return 1
+	item, err := txn.Get([]byte(minSeqKey))
+	if err == badger.ErrKeyNotFound {
+		if op._locklessReadMaxSeq(txn) > 0 {
+			return 1
+		}
+		return 0
+	} else if err != nil {
+		logger.Errorf("[get min sequence from badger failed: %v]", err)
+		return 0
+	}
+
+	v, err := item.Value()
+	if err != nil || v == nil || len(v) == 0 {
+		return 0
+	}
+
+	ms, err := strconv.ParseUint(string(v), 0, 64)
+	if err != nil {
+		logger.Errorf("[BUG: parse min sequence %s failed: %s]", string(v), err)
+		return 0
 	}
-	return 0
+
+	return ms
 }
 
 // _locklessReadMaxSeq is designed to be invoked by locked methods of opLog
@@ -323,6 +554,108 @@ func (op *opLog) _locklessWriteMaxSeq(txn *badger.Txn, ms uint64) (uint64, error
 	return ms, nil
 }
 
+// _locklessWriteMinSeq is designed to be invoked by locked methods of opLog
+func (op *opLog) _locklessWriteMinSeq(txn *badger.Txn, ms uint64) (uint64, error) {
+	err := txn.Set([]byte(minSeqKey), []byte(fmt.Sprintf("%d", ms)))
+	if err != nil {
+		logger.Errorf("[set min sequence to badger failed: %v]", err)
+		return 0, err
+	}
+
+	return ms, nil
+}
+
+// _recoverWatermark guards against a crash between a Snapshot's write
+// and _cleanup's corresponding delete leaving the min-sequence
+// watermark pointing past maxSeq; if that's observed, it's clamped
+// back down so Retrieve/Append stay consistent.
+func (op *opLog) _recoverWatermark() error {
+	op.Lock()
+	defer op.Unlock()
+
+	txn := op.db.NewTransaction(true)
+	defer txn.Discard()
+
+	ms := op._locklessReadMaxSeq(txn)
+	minSeq := op._locklessReadMinSeq(txn)
+	if minSeq <= ms+1 {
+		return nil
+	}
+
+	logger.Errorf("[BUG: oplog min sequence %d is beyond max sequence %d, clamping]", minSeq, ms)
+	_, err := op._locklessWriteMinSeq(txn, ms+1)
+	if err != nil {
+		return err
+	}
+
+	return txn.Commit(nil)
+}
+
+// _cleanup periodically discards compacted operations and reclaims
+// badger's value log space.
 func (op *opLog) _cleanup() {
-	// TODO: clean very old values
-}
\ No newline at end of file
+	op.RLock()
+	interval := op.cleanupInterval
+	op.RUnlock()
+	if interval <= 0 {
+		interval = defaultCleanupInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		op._compact()
+
+		op.RLock()
+		current := op.cleanupInterval
+		op.RUnlock()
+		if current > 0 && current != interval {
+			interval = current
+			ticker.Reset(interval)
+		}
+	}
+}
+
+// _compact deletes every raw operation below the current min-sequence
+// watermark in batched transactions, then reclaims the freed vlog
+// space. Deletes only ever target sequences a Snapshot has already
+// superseded, so it's safe to run concurrently with Append/Retrieve.
+func (op *opLog) _compact() {
+	op.RLock()
+	txn := op.db.NewTransaction(false)
+	minSeq := op._locklessReadMinSeq(txn)
+	txn.Discard()
+	op.RUnlock()
+
+	for seq := uint64(1); seq < minSeq; seq += cleanupBatchSize {
+		end := seq + cleanupBatchSize
+		if end > minSeq {
+			end = minSeq
+		}
+
+		op.Lock()
+		txn := op.db.NewTransaction(true)
+		for s := seq; s < end; s++ {
+			if err := txn.Delete([]byte(fmt.Sprintf("%d", s))); err != nil {
+				logger.Errorf("[delete operation (sequence=%d) from badger failed: %v]", s, err)
+			}
+		}
+		err := txn.Commit(nil)
+		txn.Discard()
+		op.Unlock()
+
+		if err != nil {
+			logger.Errorf("[BUG: commit compaction batch [%d, %d) failed: %v]", seq, end, err)
+			return
+		}
+	}
+
+	if minSeq <= 1 {
+		return
+	}
+
+	if err := op.db.RunValueLogGC(0.5); err != nil && err != badger.ErrNoRewrite {
+		logger.Errorf("[run value log gc failed: %v]", err)
+	}
+}
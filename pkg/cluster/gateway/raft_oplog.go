@@ -0,0 +1,410 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+
+	"github.com/hexdecteam/easegateway/pkg/common"
+	"github.com/hexdecteam/easegateway/pkg/logger"
+
+	"github.com/megaease/easegateway/pkg/scheduler"
+)
+
+type (
+	// RaftOpLogConfig configures a RaftOpLog node.
+	RaftOpLogConfig struct {
+		LocalID  string
+		BindAddr string
+		// Peers lists the other raft.ServerID/raft.ServerAddress pairs
+		// (as "id@addr") of the initial cluster; discovery beyond the
+		// initial bootstrap is left to the cluster layer.
+		Peers   []string
+		DataDir string
+		// Bootstrap marks this node as the seed that forms a brand new
+		// cluster from LocalID+Peers. Exactly one node in a fresh
+		// cluster should set it; nodes rejoining an existing cluster,
+		// or restarting with on-disk raft state, must leave it false
+		// and join via the cluster layer's membership change instead.
+		Bootstrap bool
+	}
+
+	// RaftOpLogSpec is the scheduler.Register-facing spec for the
+	// "RaftOpLog" object kind; its fields mirror RaftOpLogConfig plus
+	// the Name/Kind every object spec carries.
+	RaftOpLogSpec struct {
+		scheduler.ObjectMeta `yaml:",inline"`
+		BindAddr             string   `yaml:"bindAddr" v:"required"`
+		Peers                []string `yaml:"peers" v:"omitempty,dive,required"`
+		DataDir              string   `yaml:"dataDir" v:"required"`
+		Bootstrap            bool     `yaml:"bootstrap"`
+	}
+
+	// RaftOpLog is an OpLogStore backed by a raft log: Append proposes
+	// entries through the leader, and Retrieve serves already-committed
+	// entries from the local FSM. The operation sequence is a private
+	// counter the FSM increments once per applied operation — NOT the
+	// raft log index, since bootstrap configuration entries and the
+	// no-op raft appends on every leader election also consume indices
+	// without ever reaching FSM.Apply, which would otherwise leave gaps
+	// in the sequence.
+	RaftOpLog struct {
+		sync.RWMutex
+		raft                       *raft.Raft
+		fsm                        *opLogFSM
+		operationAppendedCallbacks *common.NamedCallbackSet
+		config                     RaftOpLogConfig
+	}
+
+	// RaftOpLogStatus reports this node's raft role, term and log
+	// indices, matching the StatusMeta/Timestamp contract enforced by
+	// scheduler.Register.
+	RaftOpLogStatus struct {
+		scheduler.StatusMeta `yaml:",inline"`
+		Role                 string `yaml:"role"`
+		Term                 uint64 `yaml:"term"`
+		CommitIndex          uint64 `yaml:"commitIndex"`
+		LastApplied          uint64 `yaml:"lastApplied"`
+	}
+
+	opLogFSM struct {
+		sync.RWMutex
+		maxSeq     uint64
+		operations map[uint64]*Operation
+		onApply    func(seq uint64, operation *Operation)
+	}
+
+	fsmSnapshot struct {
+		operations map[uint64]*Operation
+		maxSeq     uint64
+	}
+)
+
+var (
+	_ OpLogStore       = (*RaftOpLog)(nil)
+	_ scheduler.Object = (*RaftOpLog)(nil)
+)
+
+func init() {
+	scheduler.Register(&scheduler.ObjectRecord{
+		Kind:            "RaftOpLog",
+		DefaultSpecFunc: DefaultRaftOpLogSpec,
+		NewFunc:         NewRaftOpLogObject,
+		// RaftOpLog has no dependencies of its own; objects that read
+		// from it (anything building on OpLogStore) are the ones that
+		// should list "RaftOpLog" in their own DependObjectKinds so the
+		// scheduler starts this before them.
+		DependObjectKinds: []string{},
+	})
+}
+
+// DefaultRaftOpLogSpec returns a RaftOpLogSpec with its zero-value
+// defaults; BindAddr, Peers and DataDir still need to be supplied by
+// the operator.
+func DefaultRaftOpLogSpec() *RaftOpLogSpec {
+	return &RaftOpLogSpec{}
+}
+
+// NewRaftOpLogObject adapts RaftOpLogSpec to RaftOpLogConfig and starts
+// a RaftOpLog, matching the scheduler.Register NewFunc contract
+// (spec, prev, handlers) -> Object. prev is ignored: RaftOpLog rejoins
+// cluster state from its own DataDir rather than from the previous
+// generation's in-memory object.
+func NewRaftOpLogObject(spec *RaftOpLogSpec, prev *RaftOpLog, handlers *sync.Map) *RaftOpLog {
+	rl, err := NewRaftOpLog(RaftOpLogConfig{
+		LocalID:   spec.Name,
+		BindAddr:  spec.BindAddr,
+		Peers:     spec.Peers,
+		DataDir:   spec.DataDir,
+		Bootstrap: spec.Bootstrap,
+	})
+	if err != nil {
+		logger.Errorf("[create raft oplog %s failed: %v]", spec.Name, err)
+		return nil
+	}
+
+	return rl
+}
+
+// NewRaftOpLog starts (or rejoins) a raft-replicated operation log.
+func NewRaftOpLog(config RaftOpLogConfig) (*RaftOpLog, error) {
+	fsm := &opLogFSM{operations: make(map[uint64]*Operation)}
+
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = raft.ServerID(config.LocalID)
+
+	addr, err := net.ResolveTCPAddr("tcp", config.BindAddr)
+	if err != nil {
+		return nil, fmt.Errorf("resolve raft bind address %s failed: %v", config.BindAddr, err)
+	}
+
+	transport, err := raft.NewTCPTransport(config.BindAddr, addr, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("create raft transport failed: %v", err)
+	}
+
+	logStore, err := raftboltdb.NewBoltStore(filepath.Join(config.DataDir, "raft-log.db"))
+	if err != nil {
+		return nil, fmt.Errorf("create raft log store failed: %v", err)
+	}
+
+	stableStore, err := raftboltdb.NewBoltStore(filepath.Join(config.DataDir, "raft-stable.db"))
+	if err != nil {
+		return nil, fmt.Errorf("create raft stable store failed: %v", err)
+	}
+
+	snapshotStore, err := raft.NewFileSnapshotStore(config.DataDir, 2, os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("create raft snapshot store failed: %v", err)
+	}
+
+	r, err := raft.NewRaft(raftConfig, fsm, logStore, stableStore, snapshotStore, transport)
+	if err != nil {
+		return nil, fmt.Errorf("create raft node failed: %v", err)
+	}
+
+	hasState, err := raft.HasExistingState(logStore, stableStore, snapshotStore)
+	if err != nil {
+		return nil, fmt.Errorf("check raft existing state failed: %v", err)
+	}
+
+	if config.Bootstrap && !hasState {
+		servers := []raft.Server{{ID: raftConfig.LocalID, Address: transport.LocalAddr()}}
+		for _, peer := range config.Peers {
+			id, peerAddr := peer, peer
+			if i := strings.IndexByte(peer, '@'); i >= 0 {
+				id, peerAddr = peer[:i], peer[i+1:]
+			}
+			servers = append(servers, raft.Server{ID: raft.ServerID(id), Address: raft.ServerAddress(peerAddr)})
+		}
+		if err := r.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+			return nil, fmt.Errorf("bootstrap raft cluster failed: %v", err)
+		}
+	}
+
+	op := &RaftOpLog{
+		raft:                       r,
+		fsm:                        fsm,
+		operationAppendedCallbacks: common.NewNamedCallbackSet(),
+		config:                     config,
+	}
+	fsm.onApply = op.fireAppendedCallbacks
+
+	return op, nil
+}
+
+// Append proposes operations through the leader. Non-leader nodes
+// reject the call with the current leader's address so the caller can
+// forward the request instead of failing it outright.
+//
+// The whole batch is marshaled into a single raft.Apply call, so it
+// becomes one raft log entry: either all of it commits, or none of it
+// does. Applying each operation as its own raft.Apply would let a
+// leadership change land between two of them, committing only a
+// prefix of the batch.
+func (rl *RaftOpLog) Append(startSeq uint64, operations []*Operation) (error, ClusterErrorType) {
+	if len(operations) == 0 {
+		return nil, NoneClusterError
+	}
+
+	if rl.raft.State() != raft.Leader {
+		leaderAddr, _ := rl.raft.LeaderWithID()
+		return fmt.Errorf("not leader, forward to %s", leaderAddr), NotLeaderError
+	}
+
+	current := rl.MaxSeq()
+	if startSeq != current+1 {
+		return fmt.Errorf("operation conflict"), OperationSeqConflictError
+	}
+
+	buf, err := json.Marshal(operations)
+	if err != nil {
+		return fmt.Errorf("marshal operations failed: %v", err), OperationInvalidContentError
+	}
+
+	future := rl.raft.Apply(buf, 10*time.Second)
+	if err := future.Error(); err != nil {
+		logger.Errorf("[raft apply failed: %v]", err)
+		return fmt.Errorf("raft apply failed: %v", err), InternalServerError
+	}
+
+	return nil, NoneClusterError
+}
+
+// Retrieve serves already-committed entries from the local FSM;
+// followers never need to contact the leader to read.
+func (rl *RaftOpLog) Retrieve(startSeq, countLimit uint64) ([]*Operation, error, ClusterErrorType) {
+	if startSeq == 0 {
+		return nil, fmt.Errorf("invalid begin sequential operation"), InternalServerError
+	}
+
+	rl.fsm.RLock()
+	defer rl.fsm.RUnlock()
+
+	var ret []*Operation
+	for idx := uint64(0); idx < countLimit; idx++ {
+		seq := startSeq + idx
+		if seq > rl.fsm.maxSeq {
+			break
+		}
+		if operation, exists := rl.fsm.operations[seq]; exists {
+			ret = append(ret, operation)
+		}
+	}
+
+	return ret, nil, NoneClusterError
+}
+
+// MaxSeq is the highest private sequence counter applied to the local FSM.
+func (rl *RaftOpLog) MaxSeq() uint64 {
+	rl.fsm.RLock()
+	defer rl.fsm.RUnlock()
+	return rl.fsm.maxSeq
+}
+
+// MinSeq is always 1: compaction for RaftOpLog rides on raft's own
+// snapshot-and-truncate cycle rather than opLog's watermark.
+func (rl *RaftOpLog) MinSeq() uint64 {
+	return 1
+}
+
+// Snapshot triggers a raft snapshot; payload is ignored since the FSM
+// already knows how to serialize its own applied state.
+func (rl *RaftOpLog) Snapshot(seq uint64, payload []byte) error {
+	return rl.raft.Snapshot().Error()
+}
+
+// Close shuts the raft node down.
+func (rl *RaftOpLog) Close() error {
+	return rl.raft.Shutdown().Error()
+}
+
+func (rl *RaftOpLog) AddOPLogAppendedCallback(name string, callback OperationAppended, priority string) {
+	rl.Lock()
+	rl.operationAppendedCallbacks = common.AddCallback(rl.operationAppendedCallbacks, name, callback, priority)
+	rl.Unlock()
+}
+
+// fireAppendedCallbacks runs on every node once an entry is applied,
+// i.e. after commit, so all Easegress instances observe the same
+// applied stream regardless of which one is leader.
+func (rl *RaftOpLog) fireAppendedCallbacks(seq uint64, operation *Operation) {
+	rl.RLock()
+	callbacks := rl.operationAppendedCallbacks.GetCallbacks()
+	rl.RUnlock()
+
+	for _, cb := range callbacks {
+		if err, failureType := cb.Callback().(OperationAppended)(seq, operation); err != nil {
+			logger.Errorf("[operation (sequence=%d) failed (failure type=%d): %v]", seq, failureType, err)
+		}
+	}
+}
+
+// Status reports role, term, commit index and last applied index.
+func (rl *RaftOpLog) Status() *RaftOpLogStatus {
+	stats := rl.raft.Stats()
+
+	term, _ := strconv.ParseUint(stats["term"], 10, 64)
+	commitIndex, _ := strconv.ParseUint(stats["commit_index"], 10, 64)
+	lastApplied, _ := strconv.ParseUint(stats["applied_index"], 10, 64)
+
+	return &RaftOpLogStatus{
+		Role:        stats["state"],
+		Term:        term,
+		CommitIndex: commitIndex,
+		LastApplied: lastApplied,
+	}
+}
+
+// Apply implements raft.FSM. It's only invoked for committed
+// LogCommand entries, so incrementing a private counter here — rather
+// than trusting entry.Index — gives every node the same contiguous
+// operation sequence regardless of how many config/no-op entries raft
+// interleaved to get there. entry.Data is the whole batch Append
+// proposed in one raft.Apply call, so every operation in it lands
+// under a single lock acquisition and gets contiguous sequences.
+func (f *opLogFSM) Apply(entry *raft.Log) interface{} {
+	var operations []*Operation
+	if err := json.Unmarshal(entry.Data, &operations); err != nil {
+		logger.Errorf("[BUG: unmarshal raft log entry (index=%d) failed: %v]", entry.Index, err)
+		return err
+	}
+
+	seqs := make([]uint64, len(operations))
+	f.Lock()
+	for i, operation := range operations {
+		f.maxSeq++
+		seqs[i] = f.maxSeq
+		f.operations[seqs[i]] = operation
+	}
+	f.Unlock()
+
+	if f.onApply != nil {
+		for i, operation := range operations {
+			f.onApply(seqs[i], operation)
+		}
+	}
+
+	return nil
+}
+
+func (f *opLogFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.RLock()
+	defer f.RUnlock()
+
+	copied := make(map[uint64]*Operation, len(f.operations))
+	for seq, operation := range f.operations {
+		copied[seq] = operation
+	}
+
+	return &fsmSnapshot{operations: copied, maxSeq: f.maxSeq}, nil
+}
+
+func (f *opLogFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	var snap struct {
+		Operations map[uint64]*Operation `json:"operations"`
+		MaxSeq     uint64                `json:"maxSeq"`
+	}
+	if err := json.NewDecoder(rc).Decode(&snap); err != nil {
+		return fmt.Errorf("decode raft snapshot failed: %v", err)
+	}
+
+	f.Lock()
+	f.operations = snap.Operations
+	f.maxSeq = snap.MaxSeq
+	f.Unlock()
+
+	return nil
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	data, err := json.Marshal(struct {
+		Operations map[uint64]*Operation `json:"operations"`
+		MaxSeq     uint64                `json:"maxSeq"`
+	}{s.operations, s.maxSeq})
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	if _, err := sink.Write(data); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {}
@@ -0,0 +1,17 @@
+package gateway
+
+// OpLogStore is the storage contract behind every call site that used
+// to reach into *opLog directly. Pulling it out lets a single-node
+// badger-backed store and a multi-node Raft-replicated store (see
+// RaftOpLog) be swapped in without touching callers.
+type OpLogStore interface {
+	Append(startSeq uint64, operations []*Operation) (error, ClusterErrorType)
+	Retrieve(startSeq, countLimit uint64) ([]*Operation, error, ClusterErrorType)
+	MaxSeq() uint64
+	MinSeq() uint64
+	Snapshot(seq uint64, payload []byte) error
+	Close() error
+	AddOPLogAppendedCallback(name string, callback OperationAppended, priority string)
+}
+
+var _ OpLogStore = (*opLog)(nil)
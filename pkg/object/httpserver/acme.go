@@ -0,0 +1,187 @@
+package httpserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/megaease/easegateway/pkg/logger"
+)
+
+const acmeChallengePrefix = "/.well-known/acme-challenge/"
+
+type (
+	// KVBackend is the minimal pluggable storage interface ACMEManager
+	// needs to persist the account key and issued certificates. A
+	// cluster-backed implementation lets every Easegress node share a
+	// single cert set and avoid redundant challenges.
+	KVBackend interface {
+		Get(ctx context.Context, key string) ([]byte, error)
+		Put(ctx context.Context, key string, value []byte) error
+		Delete(ctx context.Context, key string) error
+	}
+
+	// ACMEManager drives the ACME client for a HTTPServer: it obtains
+	// and renews certificates, serves HTTP-01 challenges and hot-swaps
+	// tls.Config.GetCertificate without restarting the listener.
+	ACMEManager struct {
+		spec    *ACMESpec
+		manager *autocert.Manager
+
+		// mu guards the fields below, which GetCertificate writes on
+		// every TLS handshake (so concurrently) and Status reads.
+		mu             sync.Mutex
+		expiry         time.Time
+		lastRenewal    time.Time
+		lastRenewError string
+	}
+
+	// kvCache adapts a KVBackend into autocert.Cache, gzip-compressing
+	// every blob before it hits the backend.
+	kvCache struct {
+		namespace string
+		backend   KVBackend
+	}
+)
+
+// NewACMEManager builds an ACMEManager from spec, storing account/cert
+// material under backend.
+func NewACMEManager(spec *ACMESpec, backend KVBackend) (*ACMEManager, error) {
+	if spec == nil || !spec.Enabled {
+		return nil, fmt.Errorf("acme is not enabled")
+	}
+	if backend == nil {
+		return nil, fmt.Errorf("acme storage backend is nil")
+	}
+
+	am := &ACMEManager{spec: spec}
+
+	am.manager = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      &kvCache{namespace: spec.Storage, backend: backend},
+		HostPolicy: autocert.HostWhitelist(spec.Domains...),
+		Email:      spec.Email,
+	}
+	if spec.CADirectoryURL != "" {
+		am.manager.Client = &acme.Client{DirectoryURL: spec.CADirectoryURL}
+	}
+
+	return am, nil
+}
+
+// GetCertificate is wired into tls.Config.GetCertificate; the returned
+// certificate reflects whatever autocert currently holds, so renewals
+// are picked up without restarting the listener. It's called on every
+// handshake, most of which are cache hits, so lastRenewal only moves
+// when the served certificate's expiry actually changes — not on
+// every call.
+func (am *ACMEManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := am.manager.GetCertificate(hello)
+	if err != nil {
+		am.mu.Lock()
+		am.lastRenewError = err.Error()
+		am.mu.Unlock()
+		logger.Errorf("[acme get certificate for %s failed: %v]", hello.ServerName, err)
+		return nil, err
+	}
+
+	am.mu.Lock()
+	am.lastRenewError = ""
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		logger.Errorf("[BUG: parse acme certificate for %s failed: %v]", hello.ServerName, err)
+	} else if !leaf.NotAfter.Equal(am.expiry) {
+		am.expiry = leaf.NotAfter
+		am.lastRenewal = time.Now()
+	}
+	am.mu.Unlock()
+
+	return cert, nil
+}
+
+// ChallengeHandler returns an http.Handler serving HTTP-01 challenges
+// under acmeChallengePrefix; callers should carve this prefix out of
+// their own mux ahead of normal routing.
+func (am *ACMEManager) ChallengeHandler(fallback http.Handler) http.Handler {
+	return am.manager.HTTPHandler(fallback)
+}
+
+// Handles reports whether path falls under the ACME HTTP-01 challenge
+// prefix, so HTTPServer.ServeHTTP can carve it out ahead of Rule
+// routing.
+func (am *ACMEManager) Handles(path string) bool {
+	return strings.HasPrefix(path, acmeChallengePrefix)
+}
+
+// Status reports the current renewal state for the object's Status.
+func (am *ACMEManager) Status() *ACMEStatus {
+	am.mu.Lock()
+	expiry, lastRenewal, lastRenewError := am.expiry, am.lastRenewal, am.lastRenewError
+	am.mu.Unlock()
+
+	status := &ACMEStatus{
+		Domains:        am.spec.Domains,
+		LastRenewError: lastRenewError,
+	}
+	if !expiry.IsZero() {
+		status.Expiry = expiry.Format(time.RFC3339)
+	}
+	if !lastRenewal.IsZero() {
+		status.LastRenewal = lastRenewal.Format(time.RFC3339)
+	}
+	return status
+}
+
+func (c *kvCache) Get(ctx context.Context, key string) ([]byte, error) {
+	compressed, err := c.backend.Get(ctx, c.namespace+"/"+key)
+	if err != nil {
+		return nil, err
+	}
+	if compressed == nil {
+		return nil, autocert.ErrCacheMiss
+	}
+	return gunzip(compressed)
+}
+
+func (c *kvCache) Put(ctx context.Context, key string, data []byte) error {
+	compressed, err := gzipBytes(data)
+	if err != nil {
+		return err
+	}
+	return c.backend.Put(ctx, c.namespace+"/"+key, compressed)
+}
+
+func (c *kvCache) Delete(ctx context.Context, key string) error {
+	return c.backend.Delete(ctx, c.namespace+"/"+key)
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
@@ -0,0 +1,282 @@
+package httpserver
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/megaease/easegateway/pkg/logger"
+	"github.com/megaease/easegateway/pkg/scheduler"
+	"github.com/megaease/easegateway/pkg/util/ipfilter"
+)
+
+type ipFamily int
+
+const (
+	ipFamilyV4 ipFamily = iota
+	ipFamilyV6
+)
+
+type familyContextKey struct{}
+
+// ACMEKVBackend is the pluggable storage every ACME-enabled HTTPServer
+// persists its account key and issued certs through; the cluster layer
+// sets it once at startup, before any HTTPServer object is created, so
+// every node shares it (see ACMESpec.Storage).
+var ACMEKVBackend KVBackend
+
+type (
+	// HTTPServer is the Object implementation of Spec: it owns one
+	// net.Listener per spec.effectiveBindAddresses() entry, terminates
+	// TLS when spec.HTTPS is set (from a static cert or from ACME), and
+	// routes each request to the Rule/Path matching its Host and
+	// path/method, dispatching to the backend handler registered under
+	// that Path's name in handlers.
+	HTTPServer struct {
+		spec     *Spec
+		handlers *sync.Map
+		acme     *ACMEManager
+
+		mu      sync.Mutex
+		servers []*http.Server
+		closed  bool
+	}
+)
+
+func init() {
+	scheduler.Register(&scheduler.ObjectRecord{
+		Kind:              "HTTPServer",
+		DefaultSpecFunc:   DefaultSpec,
+		NewFunc:           New,
+		DependObjectKinds: []string{},
+	})
+}
+
+// DefaultSpec returns a Spec with HTTPServer's zero-value defaults.
+func DefaultSpec() *Spec {
+	return &Spec{}
+}
+
+var _ scheduler.Object = (*HTTPServer)(nil)
+
+// New builds an HTTPServer from spec: it closes prev's listeners
+// (rebinding the same ports for the new generation), then opens one
+// listener per spec.effectiveBindAddresses() entry and starts serving.
+func New(spec *Spec, prev *HTTPServer, handlers *sync.Map) *HTTPServer {
+	if prev != nil {
+		prev.Close()
+	}
+
+	hs := &HTTPServer{spec: spec, handlers: handlers}
+
+	var tlsConfig *tls.Config
+	if spec.HTTPS {
+		config, acme, err := hs.buildTLSConfig()
+		if err != nil {
+			logger.Errorf("[build tls config for %s failed: %v]", spec.Name, err)
+			return nil
+		}
+		tlsConfig = config
+		hs.acme = acme
+	}
+
+	for _, addr := range spec.effectiveBindAddresses() {
+		if err := hs.serve(addr, tlsConfig); err != nil {
+			logger.Errorf("[listen on %s:%d failed: %v]", addr, spec.Port, err)
+			hs.Close()
+			return nil
+		}
+	}
+
+	return hs
+}
+
+// buildTLSConfig drives the listener's TLS either from ACME, when
+// spec.ACME is enabled, or from the static CertBase64/KeyBase64 pair.
+func (hs *HTTPServer) buildTLSConfig() (*tls.Config, *ACMEManager, error) {
+	if hs.spec.ACME != nil && hs.spec.ACME.Enabled {
+		if ACMEKVBackend == nil {
+			return nil, nil, fmt.Errorf("acme is enabled but no ACMEKVBackend is configured")
+		}
+		am, err := NewACMEManager(hs.spec.ACME, ACMEKVBackend)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{GetCertificate: am.GetCertificate}, am, nil
+	}
+
+	tlsConfig, err := hs.spec.tlsConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	return tlsConfig, nil, nil
+}
+
+// serve opens one net.Listener on addr:spec.Port and starts an
+// http.Server on it in the background. On a wildcard IPv6 address it
+// sets IPV6_V6ONLY to spec.IPv6Only through net.ListenConfig.Control:
+// with IPv6Only set the listener never also accepts IPv4-mapped
+// connections, so it can share the port with a "0.0.0.0" listener;
+// without it the listener is dual-stack.
+func (hs *HTTPServer) serve(addr string, tlsConfig *tls.Config) error {
+	ip := net.ParseIP(addr)
+	family := ipFamilyV4
+	if ip.To4() == nil {
+		family = ipFamilyV6
+	}
+
+	lc := net.ListenConfig{}
+	if family == ipFamilyV6 && ip.Equal(net.IPv6unspecified) {
+		v6only := hs.spec.IPv6Only
+		lc.Control = func(_, _ string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, boolToInt(v6only))
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+
+	ln, err := lc.Listen(context.Background(), "tcp", net.JoinHostPort(addr, strconv.Itoa(int(hs.spec.Port))))
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler: hs,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, familyContextKey{}, family)
+		},
+	}
+	if tlsConfig != nil {
+		server.TLSConfig = tlsConfig
+	}
+
+	hs.mu.Lock()
+	hs.servers = append(hs.servers, server)
+	hs.mu.Unlock()
+
+	go func() {
+		var serveErr error
+		if tlsConfig != nil {
+			serveErr = server.ServeTLS(ln, "", "")
+		} else {
+			serveErr = server.Serve(ln)
+		}
+		if serveErr != nil && serveErr != http.ErrServerClosed {
+			logger.Errorf("[serve on %s failed: %v]", ln.Addr(), serveErr)
+		}
+	}()
+
+	return nil
+}
+
+// ServeHTTP carves ACME HTTP-01 challenges out ahead of Rule routing,
+// then normalizes the request's Host and routes it to the Rule and
+// Path it matches, dispatching to that Path's backend handler.
+func (hs *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if hs.acme != nil && hs.acme.Handles(r.URL.Path) {
+		hs.acme.ChallengeHandler(http.HandlerFunc(hs.serveRule)).ServeHTTP(w, r)
+		return
+	}
+	hs.serveRule(w, r)
+}
+
+func (hs *HTTPServer) serveRule(w http.ResponseWriter, r *http.Request) {
+	family, _ := r.Context().Value(familyContextKey{}).(ipFamily)
+
+	rule := hs.spec.ruleForHost(normalizeHost(r.Host))
+	if rule == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	path := rule.matchPath(r.Method, r.URL.Path)
+	if path == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if ipFilter := hs.spec.effectiveIPFilter(rule, path, family); ipFilter != nil && !ipAllowed(ipFilter, r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	handler, ok := hs.handlers.Load(path.Backend)
+	if !ok {
+		http.Error(w, fmt.Sprintf("backend %s not found", path.Backend), http.StatusBadGateway)
+		return
+	}
+	handler.(http.Handler).ServeHTTP(w, r)
+}
+
+// Close shuts every listener down; it's safe to call more than once
+// and safe to call on a nil HTTPServer (New returns nil on failure).
+func (hs *HTTPServer) Close() {
+	if hs == nil {
+		return
+	}
+
+	hs.mu.Lock()
+	if hs.closed {
+		hs.mu.Unlock()
+		return
+	}
+	hs.closed = true
+	servers := hs.servers
+	hs.mu.Unlock()
+
+	for _, server := range servers {
+		if err := server.Close(); err != nil {
+			logger.Errorf("[close http server failed: %v]", err)
+		}
+	}
+}
+
+// Status reports the HTTPServer's status, including ACME renewal state
+// when it's enabled.
+func (hs *HTTPServer) Status() *Status {
+	status := &Status{}
+	if hs.acme != nil {
+		status.ACME = hs.acme.Status()
+	}
+	return status
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var (
+	ipFilterCacheMu sync.Mutex
+	ipFilterCache   = map[*ipfilter.Spec]*ipfilter.IPFilter{}
+)
+
+// ipAllowed reports whether r's remote IP is allowed by spec, building
+// (and caching, keyed by spec's identity) the ipfilter.IPFilter for it
+// on first use.
+func ipAllowed(spec *ipfilter.Spec, r *http.Request) bool {
+	ipFilterCacheMu.Lock()
+	filter, ok := ipFilterCache[spec]
+	if !ok {
+		filter = ipfilter.New(spec)
+		ipFilterCache[spec] = filter
+	}
+	ipFilterCacheMu.Unlock()
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return filter.Allow(host)
+}
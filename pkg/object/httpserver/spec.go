@@ -4,12 +4,22 @@ import (
 	"crypto/tls"
 	"encoding/base64"
 	"fmt"
+	"net"
 	"regexp"
+	"strings"
 
 	"github.com/megaease/easegateway/pkg/scheduler"
 	"github.com/megaease/easegateway/pkg/util/ipfilter"
 )
 
+// DefaultBindAddresses are used when Spec.BindAddresses is empty. A
+// lone "::" gives dual-stack binding out of the box through a single
+// listener: on Linux, net.ipv6.bindv6only defaults to 0, so a wildcard
+// IPv6 listener also accepts IPv4-mapped connections. Pairing it with
+// an explicit "0.0.0.0" listener, as an earlier version of this
+// default did, binds the same port twice and fails with EADDRINUSE.
+var DefaultBindAddresses = []string{"::"}
+
 type (
 	// Spec describes the HTTPServer.
 	Spec struct {
@@ -25,8 +35,46 @@ type (
 		KeyBase64            string `yaml:"keyBase64" v:"omitempty,base64"`
 		CacheSize            uint32 `yaml:"cacheSize" v:"omitempty"`
 
+		ACME *ACMESpec `yaml:"acme" v:"omitempty"`
+
+		// BindAddresses lists the local addresses the HTTPServer opens
+		// one net.Listener per; it defaults to DefaultBindAddresses
+		// (dual-stack) when empty.
+		BindAddresses []string `yaml:"bindAddresses" v:"omitempty,dive,required"`
+		// IPv6Only sets IPV6_V6ONLY on "::"/"::0" listeners so they
+		// never also accept IPv4-mapped connections, which is required
+		// when BindAddresses binds both an IPv4 and an IPv6 wildcard
+		// address on the same port.
+		IPv6Only bool `yaml:"ipv6Only"`
+
 		IPFilter *ipfilter.Spec `yaml:"ipFilter" v:"omitempty"`
-		Rules    []Rule         `yaml:"rules" v:"dive"`
+		// IPFilterV4/IPFilterV6 override IPFilter for connections
+		// accepted on an IPv4 or IPv6 listener respectively.
+		IPFilterV4 *ipfilter.Spec `yaml:"ipFilterV4" v:"omitempty"`
+		IPFilterV6 *ipfilter.Spec `yaml:"ipFilterV6" v:"omitempty"`
+
+		Rules []Rule `yaml:"rules" v:"dive"`
+	}
+
+	// ACMESpec describes how the HTTPServer obtains and renews its own
+	// TLS certificate through an ACME CA (e.g. Let's Encrypt) instead of
+	// a statically configured CertBase64/KeyBase64 pair.
+	ACMESpec struct {
+		Enabled bool   `yaml:"enabled"`
+		Email   string `yaml:"email" v:"omitempty,email"`
+		// Domains lists the hostnames to request a certificate for.
+		// Every entry must also appear as a Rule.Host or be matched by
+		// a Rule.HostRegexp, otherwise no traffic would ever reach the
+		// HTTP-01 challenge for it.
+		Domains []string `yaml:"domains" v:"omitempty,dive,required"`
+		// CADirectoryURL defaults to Let's Encrypt's production
+		// directory when empty.
+		CADirectoryURL string `yaml:"caDirectoryURL" v:"omitempty,url"`
+		// Storage is the key namespace under which the account key and
+		// issued certificates are persisted in ACMEKVBackend, shared by
+		// every node in the cluster so renewals and challenges aren't
+		// duplicated.
+		Storage string `yaml:"storage" v:"omitempty"`
 	}
 
 	// Rule is first level entry of router.
@@ -54,6 +102,33 @@ type (
 
 // Validate validates HTTPServerSpec.
 func (spec *Spec) Validate() error {
+	if err := spec.validateBindAddresses(); err != nil {
+		return err
+	}
+
+	if err := spec.compileRules(); err != nil {
+		return err
+	}
+
+	if spec.ACME != nil && spec.ACME.Enabled {
+		if spec.CertBase64 != "" || spec.KeyBase64 != "" {
+			return fmt.Errorf("acme is enabled but certBase64/keyBase64 is also set")
+		}
+		if !spec.HTTPS {
+			return fmt.Errorf("acme is enabled but https is false")
+		}
+		if len(spec.ACME.Domains) == 0 {
+			return fmt.Errorf("acme is enabled but domains is empty")
+		}
+		for _, domain := range spec.ACME.Domains {
+			if !spec.domainCoveredByRules(domain) {
+				return fmt.Errorf("acme domain %s matches no rule host/hostRegexp", domain)
+			}
+		}
+
+		return nil
+	}
+
 	if spec.HTTPS {
 		if spec.CertBase64 == "" {
 			return fmt.Errorf("cert is empty when https enabled")
@@ -70,6 +145,187 @@ func (spec *Spec) Validate() error {
 	return nil
 }
 
+// domainCoveredByRules reports whether domain is reachable through at
+// least one of spec.Rules, either via an exact Host match or a
+// HostRegexp match. It's called from Validate after compileRules, so
+// rule.hostRE is already populated.
+func (spec *Spec) domainCoveredByRules(domain string) bool {
+	for _, rule := range spec.Rules {
+		if rule.Host == domain {
+			return true
+		}
+		if rule.hostRE != nil && rule.hostRE.MatchString(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileRules compiles every Rule's HostRegexp and Path's PathRegexp
+// once at validation time and caches the result on hostRE/pathRE, so
+// the request-routing hot path never calls regexp.Compile.
+func (spec *Spec) compileRules() error {
+	for i := range spec.Rules {
+		rule := &spec.Rules[i]
+		if rule.HostRegexp != "" {
+			re, err := regexp.Compile(rule.HostRegexp)
+			if err != nil {
+				return fmt.Errorf("compile hostRegexp %s failed: %v", rule.HostRegexp, err)
+			}
+			rule.hostRE = re
+		}
+
+		for j := range rule.Paths {
+			path := &rule.Paths[j]
+			if path.PathRegexp == "" {
+				continue
+			}
+			re, err := regexp.Compile(path.PathRegexp)
+			if err != nil {
+				return fmt.Errorf("compile pathRegexp %s failed: %v", path.PathRegexp, err)
+			}
+			path.pathRE = re
+		}
+	}
+	return nil
+}
+
+// ruleForHost returns the first Rule whose Host matches host exactly
+// or whose HostRegexp matches it, or nil if none do. host should
+// already be run through normalizeHost.
+func (spec *Spec) ruleForHost(host string) *Rule {
+	for i := range spec.Rules {
+		rule := &spec.Rules[i]
+		if rule.Host == host {
+			return rule
+		}
+		if rule.hostRE != nil && rule.hostRE.MatchString(host) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// matchPath returns the first Path under rule whose Methods (if any),
+// and Path/PathPrefix/PathRegexp (if any), match method and p. A Path
+// with none of Path/PathPrefix/PathRegexp set matches any path.
+func (rule *Rule) matchPath(method, p string) *Path {
+	for i := range rule.Paths {
+		path := &rule.Paths[i]
+		if len(path.Methods) > 0 && !stringsContain(path.Methods, method) {
+			continue
+		}
+
+		switch {
+		case path.Path != "":
+			if p == path.Path {
+				return path
+			}
+		case path.PathPrefix != "":
+			if strings.HasPrefix(p, path.PathPrefix) {
+				return path
+			}
+		case path.pathRE != nil:
+			if path.pathRE.MatchString(p) {
+				return path
+			}
+		default:
+			return path
+		}
+	}
+	return nil
+}
+
+func stringsContain(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// effectiveBindAddresses returns spec.BindAddresses, defaulting to
+// DefaultBindAddresses when unset.
+func (spec *Spec) effectiveBindAddresses() []string {
+	if len(spec.BindAddresses) > 0 {
+		return spec.BindAddresses
+	}
+	return DefaultBindAddresses
+}
+
+// validateBindAddresses rejects malformed and duplicate bind
+// addresses, plus overlapping ones: "0.0.0.0" and "::" overlap unless
+// IPv6Only is set, because on Linux a dual-stack "::" listener
+// (IPV6_V6ONLY=0) already accepts IPv4-mapped connections on the same
+// port as "0.0.0.0". The overlap check only applies when BindAddresses
+// is explicitly configured — DefaultBindAddresses is a lone "::" with
+// no "0.0.0.0" counterpart, so it never triggers this check.
+func (spec *Spec) validateBindAddresses() error {
+	var hasV4Any, hasV6Any bool
+	seen := map[string]bool{}
+
+	for _, addr := range spec.effectiveBindAddresses() {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return fmt.Errorf("invalid bind address: %s", addr)
+		}
+
+		if seen[ip.String()] {
+			return fmt.Errorf("duplicate bind address: %s", addr)
+		}
+		seen[ip.String()] = true
+
+		if ip.Equal(net.IPv4zero) {
+			hasV4Any = true
+		}
+		if ip.Equal(net.IPv6unspecified) {
+			hasV6Any = true
+		}
+	}
+
+	if len(spec.BindAddresses) > 0 && hasV4Any && hasV6Any && !spec.IPv6Only {
+		return fmt.Errorf("bind addresses %v overlap: set ipv6Only to true or bind only one wildcard address",
+			spec.effectiveBindAddresses())
+	}
+
+	return nil
+}
+
+// normalizeHost strips a Host header down to a form comparable with
+// Rule.Host/HostRegexp: the port is dropped and, for a bracketed IPv6
+// literal, so are the brackets and any zone identifier — so
+// "[::1%eth0]:8080" and "::1" compare equal.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if idx := strings.IndexByte(host, '%'); idx >= 0 {
+		host = host[:idx]
+	}
+	return host
+}
+
+// effectiveIPFilter picks the most specific configured IPFilter for a
+// request: path, then rule, then the per-family override for family,
+// then spec's catch-all. rule and path may be nil.
+func (spec *Spec) effectiveIPFilter(rule *Rule, path *Path, family ipFamily) *ipfilter.Spec {
+	if path != nil && path.IPFilter != nil {
+		return path.IPFilter
+	}
+	if rule != nil && rule.IPFilter != nil {
+		return rule.IPFilter
+	}
+	if family == ipFamilyV6 && spec.IPFilterV6 != nil {
+		return spec.IPFilterV6
+	}
+	if family == ipFamilyV4 && spec.IPFilterV4 != nil {
+		return spec.IPFilterV4
+	}
+	return spec.IPFilter
+}
+
 func (spec *Spec) tlsConfig() (*tls.Config, error) {
 	certPem, _ := base64.StdEncoding.DecodeString(spec.CertBase64)
 	keyPem, _ := base64.StdEncoding.DecodeString(spec.KeyBase64)
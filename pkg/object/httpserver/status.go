@@ -0,0 +1,22 @@
+package httpserver
+
+import "github.com/megaease/easegateway/pkg/scheduler"
+
+type (
+	// Status is the status of HTTPServer.
+	Status struct {
+		scheduler.StatusMeta `yaml:",inline"`
+
+		ACME *ACMEStatus `yaml:"acme,omitempty"`
+	}
+
+	// ACMEStatus reports the renewal state of an ACME-managed
+	// certificate so operators can see expiry/errors without reading
+	// the storage backend directly.
+	ACMEStatus struct {
+		Domains        []string `yaml:"domains"`
+		Expiry         string   `yaml:"expiry,omitempty"`
+		LastRenewal    string   `yaml:"lastRenewal,omitempty"`
+		LastRenewError string   `yaml:"lastRenewError,omitempty"`
+	}
+)